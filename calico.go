@@ -17,8 +17,10 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/vishvananda/netlink"
 
@@ -30,6 +32,8 @@ import (
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/projectcalico/cni-plugin/k8s"
 	. "github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/api"
@@ -54,6 +58,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 	if err := json.Unmarshal(args.StdinData, &conf); err != nil {
 		return fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if err := ValidateMTU(conf.MTU); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if err := ValidateSysctls(conf.Sysctls); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
 
 	ConfigureLogging(conf.LogLevel)
 
@@ -100,12 +110,16 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// Collect the result in this variable - this is ultimately what gets "returned" by this function by printing
 	// it to stdout.
-	var result *types.Result
+	var result *current.Result
+
+	// The routes returned by IPAM. These are kept separately from the result since DoNetworking adds to the routes
+	// in the result, and only these are included in the legacy result format.
+	var ipamRoutes []*types.Route
 
 	// If running under Kubernetes then branch off into the kubernetes code, otherwise handle everything in this
 	// function.
 	if orchestrator == "k8s" {
-		if result, err = k8s.CmdAddK8s(args, conf, hostname, calicoClient, endpoint); err != nil {
+		if result, ipamRoutes, err = k8s.CmdAddK8s(args, conf, hostname, calicoClient, endpoint); err != nil {
 			return err
 		}
 	} else {
@@ -135,12 +149,19 @@ func cmdAdd(args *skel.CmdArgs) error {
 			// 1) Run the IPAM plugin and make sure there's an IP address returned.
 			logger.WithFields(log.Fields{"paths": os.Getenv("CNI_PATH"),
 				"type": conf.IPAM.Type}).Debug("Looking for IPAM plugin in paths")
-			result, err = ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
-			logger.WithField("result", result).Info("Got result from IPAM plugin")
+			ipamResult, err := ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+			logger.WithField("result", ipamResult).Info("Got result from IPAM plugin")
 			if err != nil {
 				return err
 			}
 
+			// Convert the IPAM result into the current result format, whatever version the IPAM plugin returned.
+			result, err = current.NewResultFromResult(ipamResult)
+			if err != nil {
+				ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
+				return err
+			}
+
 			// Parse endpoint labels passed in by Mesos, and store in a map.
 			labels := map[string]string{}
 			for _, label := range conf.Args.Mesos.NetworkInfo.Labels.Labels {
@@ -167,6 +188,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 			fmt.Fprintf(os.Stderr, "Calico CNI using IPs: %s\n", endpoint.Spec.IPNetworks)
 
 			// 3) Set up the veth
+			ipamRoutes = append([]*types.Route{}, result.Routes...)
 			hostVethName, contVethMac, err := DoNetworking(args, conf, result, logger, "")
 			if err != nil {
 				// Cleanup IP allocation and return the error.
@@ -251,7 +273,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 
-	return result.Print()
+	return PrintResult(result, ipamRoutes, conf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -316,11 +338,45 @@ func cmdDel(args *skel.CmdArgs) error {
 		}
 	}
 
+	// Everything has been cleaned up, so the workload's state is no longer needed.
+	if ipamErr == nil {
+		if err := RemoveWorkloadState(conf, workload, args.ContainerID); err != nil {
+			logger.WithError(err).Warn("Failed to remove workload state")
+		}
+	}
+
 	// Return the IPAM error if there was one. The IPAM error will be lost if there was also an error in cleaning up
 	// the device or endpoint, but crucially, the user will know the overall operation failed.
 	return ipamErr
 }
 
+// cmdCleanup cleans up orphaned workloads on this host using the network config read from stdin.
+func cmdCleanup(minAge time.Duration) error {
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read netconf: %v", err)
+	}
+
+	conf := NetConf{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	ConfigureLogging(conf.LogLevel)
+
+	// Allow the hostname to be overridden by the network config
+	if conf.Hostname != "" {
+		hostname = conf.Hostname
+	}
+
+	calicoClient, err := CreateClient(conf)
+	if err != nil {
+		return err
+	}
+
+	return k8s.Cleanup(conf, hostname, calicoClient, minAge)
+}
+
 // VERSION is filled out during the build process (using git describe output)
 var VERSION string
 
@@ -330,6 +386,8 @@ func main() {
 	flagSet := flag.NewFlagSet("Calico", flag.ExitOnError)
 
 	version := flagSet.Bool("v", false, "Display version")
+	cleanup := flagSet.Bool("gc", false, "Clean up orphaned workloads using the network config read from stdin")
+	cleanupMinAge := flagSet.Duration("gc-min-age", 10*time.Minute, "Only clean up workloads older than this")
 	err := flagSet.Parse(os.Args[1:])
 	if err != nil {
 		fmt.Println(err)
@@ -339,10 +397,17 @@ func main() {
 		fmt.Println(VERSION)
 		os.Exit(0)
 	}
+	if *cleanup {
+		if err := cmdCleanup(*cleanupMinAge); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	if err := AddIgnoreUnknownArgs(); err != nil {
 		os.Exit(1)
 	}
 
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, version.All)
 }
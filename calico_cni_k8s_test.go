@@ -3,8 +3,10 @@ package main_test
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
 
 	"k8s.io/client-go/kubernetes"
@@ -16,14 +18,16 @@ import (
 	"syscall"
 
 	"github.com/containernetworking/cni/pkg/ns"
-	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/020"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
 	. "github.com/projectcalico/cni-plugin/test_utils"
+	"github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/k8s"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/testutils"
 	"github.com/vishvananda/netlink"
 )
 
@@ -86,7 +90,7 @@ var _ = Describe("CalicoCni", func() {
 				Expect(err).ShouldNot(HaveOccurred())
 				Eventually(session).Should(gexec.Exit())
 
-				result := types.Result{}
+				result := types020.Result{}
 				if err := json.Unmarshal(session.Out.Contents(), &result); err != nil {
 					panic(err)
 				}
@@ -117,6 +121,11 @@ var _ = Describe("CalicoCni", func() {
 					Profiles:      []string{"k8s_ns.test"},
 				}))
 
+				// The workload state is written
+				stateFile := fmt.Sprintf("/var/lib/cni/calico/test.%s_%s.json", name, containerID)
+				_, err = os.Stat(stateFile)
+				Expect(err).ShouldNot(HaveOccurred())
+
 				// Routes and interface on host - there's is nothing to assert on the routes since felix adds those.
 				//fmt.Println(Cmd("ip link show")) // Useful for debugging
 				hostVeth, err := netlink.LinkByName(interfaceName)
@@ -154,6 +163,10 @@ var _ = Describe("CalicoCni", func() {
 				Expect(err).ShouldNot(HaveOccurred())
 				Expect(endpoints.Items).Should(HaveLen(0))
 
+				// Make sure the workload state has been removed
+				_, err = os.Stat(stateFile)
+				Expect(os.IsNotExist(err)).Should(BeTrue())
+
 				// Make sure the interface has been removed from the namespace
 				targetNs, _ := ns.GetNS(netnspath)
 				err = targetNs.Do(func(_ ns.NetNS) error {
@@ -169,6 +182,602 @@ var _ = Describe("CalicoCni", func() {
 				Expect(err.Error()).Should(Equal("Link not found"))
 
 			})
+
+			Context("with sysctls", func() {
+				var name string
+
+				sysctlNetconf := func(sysctls string) string {
+					return fmt.Sprintf(`
+					{
+					  "name": "net1",
+					  "type": "calico",
+					  "etcd_endpoints": "http://%s:2379",
+					  "ipam": {
+					    "type": "host-local",
+					    "subnet": "10.0.0.0/8"
+					  },
+					  "kubernetes": {
+					    "k8s_api_root": "http://127.0.0.1:8080"
+					  },
+					  "sysctls": %s,
+					  "log_level":"info"
+					}`, os.Getenv("ETCD_IP"), sysctls)
+				}
+
+				allocations := func() int {
+					return len(HostLocalAllocations("net1"))
+				}
+
+				BeforeEach(func() {
+					name = fmt.Sprintf("run%d", rand.Uint32())
+				})
+
+				It("applies a container interface sysctl inside the container", func() {
+					netconf := sysctlNetconf(`{"container_interface": {"net.ipv4.conf.IFNAME.arp_ignore": "1"}}`)
+					_, netnspath, session, _, _, _, err := CreateContainer(netconf, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).Should(Equal(0))
+
+					targetNs, err := ns.GetNS(netnspath)
+					Expect(err).ShouldNot(HaveOccurred())
+					var value []byte
+					err = targetNs.Do(func(_ ns.NetNS) error {
+						value, err = ioutil.ReadFile("/proc/sys/net/ipv4/conf/eth0/arp_ignore")
+						return err
+					})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(strings.TrimSpace(string(value))).Should(Equal("1"))
+
+					session, err = DeleteContainer(netconf, netnspath, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+				})
+
+				It("rejects a malformed key before allocating an IP", func() {
+					before := allocations()
+
+					netconf := sysctlNetconf(`{"host_interface": {"net.ipv4.conf.IFNAME.proxy arp": "1"}}`)
+					_, _, session, _, _, _, _ := CreateContainer(netconf, name)
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).ShouldNot(Equal(0))
+					Expect(string(session.Out.Contents())).Should(ContainSubstring("net.ipv4.conf.IFNAME.proxy arp"))
+					Expect(allocations()).Should(Equal(before))
+				})
+
+				It("fails for a key that doesn't exist and releases the IP", func() {
+					before := allocations()
+
+					netconf := sysctlNetconf(`{"host_interface": {"net.ipv4.conf.IFNAME.no_such_sysctl": "1"}}`)
+					containerID, _, session, _, _, _, _ := CreateContainer(netconf, name)
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).ShouldNot(Equal(0))
+					Expect(string(session.Out.Contents())).Should(ContainSubstring("net.ipv4.conf.IFNAME.no_such_sysctl"))
+					Expect(allocations()).Should(Equal(before))
+
+					// The workload state is removed along with the allocation.
+					_, err := os.Stat(fmt.Sprintf("/var/lib/cni/calico/test.%s_%s.json", name, containerID))
+					Expect(os.IsNotExist(err)).Should(BeTrue())
+				})
+			})
+
+			It("applies the extra profiles from the network config and the pod annotation", func() {
+				profilesNetconf := fmt.Sprintf(`
+				{
+				  "name": "net1",
+				  "type": "calico",
+				  "etcd_endpoints": "http://%s:2379",
+				  "ipam": {
+				    "type": "host-local",
+				    "subnet": "10.0.0.0/8"
+				  },
+				  "kubernetes": {
+				    "k8s_api_root": "http://127.0.0.1:8080"
+				  },
+				  "policy": {"type": "k8s", "extra_profiles": ["extra-a", "extra-b"]},
+				  "log_level":"info"
+				}`, os.Getenv("ETCD_IP"))
+
+				config, err := clientcmd.DefaultClientConfig.ClientConfig()
+				Expect(err).ShouldNot(HaveOccurred())
+				clientset, err := kubernetes.NewForConfig(config)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				name := fmt.Sprintf("run%d", rand.Uint32())
+				_, err = clientset.Pods(K8S_TEST_NS).Create(&v1.Pod{
+					ObjectMeta: v1.ObjectMeta{
+						Name: name,
+						Annotations: map[string]string{
+							"cni.projectcalico.org/profiles": " monitoring-allow, ,dns-allow,monitoring-allow",
+						},
+					},
+					Spec: v1.PodSpec{Containers: []v1.Container{{
+						Name:  fmt.Sprintf("container-%s", name),
+						Image: "ignore",
+					}}},
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, netnspath, session, _, _, _, err := CreateContainer(profilesNetconf, name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+				Expect(session.ExitCode()).Should(Equal(0))
+
+				// Blank and duplicate entries in the annotation are dropped.
+				endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(1))
+				Expect(endpoints.Items[0].Spec.Profiles).Should(Equal([]string{
+					"k8s_ns.test", "extra-a", "extra-b", "monitoring-allow", "dns-allow",
+				}))
+
+				session, err = DeleteContainer(profilesNetconf, netnspath, name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("applies the extra profiles from the network config without k8s policy", func() {
+				profilesNetconf := fmt.Sprintf(`
+				{
+				  "name": "net1",
+				  "type": "calico",
+				  "etcd_endpoints": "http://%s:2379",
+				  "ipam": {
+				    "type": "host-local",
+				    "subnet": "10.0.0.0/8"
+				  },
+				  "kubernetes": {
+				    "k8s_api_root": "http://127.0.0.1:8080"
+				  },
+				  "policy": {"extra_profiles": ["extra-a", "net1", "extra-a"]},
+				  "log_level":"info"
+				}`, os.Getenv("ETCD_IP"))
+
+				name := fmt.Sprintf("run%d", rand.Uint32())
+				_, netnspath, session, _, _, _, err := CreateContainer(profilesNetconf, name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+				Expect(session.ExitCode()).Should(Equal(0))
+
+				endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(1))
+				Expect(endpoints.Items[0].Spec.Profiles).Should(Equal([]string{"net1", "extra-a"}))
+
+				session, err = DeleteContainer(profilesNetconf, netnspath, name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			It("applies the configured sysctls to the host veth", func() {
+				sysctlNetconf := fmt.Sprintf(`
+				{
+				  "name": "net1",
+				  "type": "calico",
+				  "etcd_endpoints": "http://%s:2379",
+				  "ipam": {
+				    "type": "host-local",
+				    "subnet": "10.0.0.0/8"
+				  },
+				  "kubernetes": {
+				    "k8s_api_root": "http://127.0.0.1:8080"
+				  },
+				  "sysctls": {
+				    "host_interface": {"net.ipv4.conf.IFNAME.proxy_arp": "1"}
+				  },
+				  "log_level":"info"
+				}`, os.Getenv("ETCD_IP"))
+
+				name := fmt.Sprintf("run%d", rand.Uint32())
+				interfaceName := k8s.VethNameForWorkload(fmt.Sprintf("%s.%s", K8S_TEST_NS, name))
+
+				_, netnspath, session, _, _, _, err := CreateContainer(sysctlNetconf, name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+				Expect(session.ExitCode()).Should(Equal(0))
+
+				value, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/proxy_arp", interfaceName))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(strings.TrimSpace(string(value))).Should(Equal("1"))
+
+				session, err = DeleteContainer(sysctlNetconf, netnspath, name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+			})
+
+			Context("cleaning up orphaned workloads", func() {
+				var name, stateFile, ipFile, netnspath string
+				var clientset *kubernetes.Clientset
+
+				fileExists := func(path string) bool {
+					_, err := os.Stat(path)
+					return err == nil
+				}
+
+				BeforeEach(func() {
+					config, err := clientcmd.DefaultClientConfig.ClientConfig()
+					Expect(err).ShouldNot(HaveOccurred())
+					clientset, err = kubernetes.NewForConfig(config)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					name = fmt.Sprintf("run%d", rand.Uint32())
+					_, err = clientset.Pods(K8S_TEST_NS).Create(&v1.Pod{
+						ObjectMeta: v1.ObjectMeta{Name: name},
+						Spec: v1.PodSpec{Containers: []v1.Container{{
+							Name:  fmt.Sprintf("container-%s", name),
+							Image: "ignore",
+						}}},
+					})
+					Expect(err).ShouldNot(HaveOccurred())
+
+					var containerID string
+					var session *gexec.Session
+					containerID, netnspath, session, _, _, _, err = CreateContainer(netconf, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).Should(Equal(0))
+
+					result := types020.Result{}
+					Expect(json.Unmarshal(session.Out.Contents(), &result)).To(Succeed())
+
+					// host-local records each allocation in a file named after the IP.
+					stateFile = fmt.Sprintf("/var/lib/cni/calico/test.%s_%s.json", name, containerID)
+					ipFile = fmt.Sprintf("/var/lib/cni/networks/net1/%s", result.IP4.IP.IP.String())
+					Expect(fileExists(stateFile)).Should(BeTrue())
+					Expect(fileExists(ipFile)).Should(BeTrue())
+				})
+
+				It("cleans up the workload once its pod has gone", func() {
+					Expect(clientset.Pods(K8S_TEST_NS).Delete(name, &v1.DeleteOptions{})).To(Succeed())
+
+					session, err := RunCleanup(netconf, "0s")
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session, 10).Should(gexec.Exit(0))
+
+					Expect(fileExists(stateFile)).Should(BeFalse())
+					Expect(fileExists(ipFile)).Should(BeFalse())
+					endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(endpoints.Items).Should(HaveLen(0))
+				})
+
+				It("cleans up the workload once its pod has moved to another node", func() {
+					// Recreate the pod with the same name, bound to another node.
+					Expect(clientset.Pods(K8S_TEST_NS).Delete(name, &v1.DeleteOptions{})).To(Succeed())
+					_, err := clientset.Pods(K8S_TEST_NS).Create(&v1.Pod{
+						ObjectMeta: v1.ObjectMeta{Name: name},
+						Spec: v1.PodSpec{
+							NodeName: "another-node",
+							Containers: []v1.Container{{
+								Name:  fmt.Sprintf("container-%s", name),
+								Image: "ignore",
+							}},
+						},
+					})
+					Expect(err).ShouldNot(HaveOccurred())
+
+					session, err := RunCleanup(netconf, "0s")
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session, 10).Should(gexec.Exit(0))
+
+					Expect(fileExists(stateFile)).Should(BeFalse())
+					Expect(fileExists(ipFile)).Should(BeFalse())
+					endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(endpoints.Items).Should(HaveLen(0))
+				})
+
+				It("leaves the workload alone while its pod is live", func() {
+					session, err := RunCleanup(netconf, "0s")
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session, 10).Should(gexec.Exit(0))
+
+					Expect(fileExists(stateFile)).Should(BeTrue())
+					Expect(fileExists(ipFile)).Should(BeTrue())
+					endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(endpoints.Items).Should(HaveLen(1))
+
+					session, err = DeleteContainer(netconf, netnspath, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+				})
+
+				It("skips workloads younger than the minimum age", func() {
+					Expect(clientset.Pods(K8S_TEST_NS).Delete(name, &v1.DeleteOptions{})).To(Succeed())
+
+					session, err := RunCleanup(netconf, "10m")
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session, 10).Should(gexec.Exit(0))
+
+					Expect(fileExists(stateFile)).Should(BeTrue())
+					Expect(fileExists(ipFile)).Should(BeTrue())
+					endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(endpoints.Items).Should(HaveLen(1))
+
+					session, err = DeleteContainer(netconf, netnspath, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+				})
+			})
+
+			Context("with an MTU", func() {
+				var name, interfaceName string
+				var clientset *kubernetes.Clientset
+
+				mtuNetconf := func(mtu int, policyType string) string {
+					return fmt.Sprintf(`
+					{
+					  "name": "net1",
+					  "type": "calico",
+					  "etcd_endpoints": "http://%s:2379",
+					  "ipam": {
+					    "type": "host-local",
+					    "subnet": "10.0.0.0/8"
+					  },
+					  "kubernetes": {
+					    "k8s_api_root": "http://127.0.0.1:8080"
+					  },
+					  "policy": {"type": "%s"},
+					  "mtu": %d,
+					  "log_level":"info"
+					}`, os.Getenv("ETCD_IP"), policyType, mtu)
+				}
+
+				// createPod creates the pod with the given MTU annotation, or none if it's empty.
+				createPod := func(mtuAnnotation string) {
+					pod := &v1.Pod{
+						ObjectMeta: v1.ObjectMeta{Name: name},
+						Spec: v1.PodSpec{Containers: []v1.Container{{
+							Name:  fmt.Sprintf("container-%s", name),
+							Image: "ignore",
+						}}},
+					}
+					if mtuAnnotation != "" {
+						pod.Annotations = map[string]string{"cni.projectcalico.org/mtu": mtuAnnotation}
+					}
+					_, err := clientset.Pods(K8S_TEST_NS).Create(pod)
+					Expect(err).ShouldNot(HaveOccurred())
+				}
+
+				// expectMTU runs the ADD and checks that both ends of the veth have the given MTU.
+				expectMTU := func(netconf string, mtu int) {
+					_, netnspath, session, contVeth, _, _, err := CreateContainer(netconf, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).Should(Equal(0))
+
+					hostVeth, err := netlink.LinkByName(interfaceName)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(hostVeth.Attrs().MTU).Should(Equal(mtu))
+					Expect(contVeth.Attrs().MTU).Should(Equal(mtu))
+
+					session, err = DeleteContainer(netconf, netnspath, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+				}
+
+				BeforeEach(func() {
+					config, err := clientcmd.DefaultClientConfig.ClientConfig()
+					Expect(err).ShouldNot(HaveOccurred())
+					clientset, err = kubernetes.NewForConfig(config)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					name = fmt.Sprintf("run%d", rand.Uint32())
+					interfaceName = k8s.VethNameForWorkload(fmt.Sprintf("%s.%s", K8S_TEST_NS, name))
+				})
+
+				It("applies the configured MTU to both ends of the veth", func() {
+					expectMTU(mtuNetconf(1400, ""), 1400)
+				})
+
+				It("overrides the MTU from the pod annotation", func() {
+					createPod("1350")
+					expectMTU(mtuNetconf(1400, "k8s"), 1350)
+				})
+
+				It("overrides the MTU from the pod annotation for an existing endpoint", func() {
+					createPod("1350")
+
+					endpoint := api.NewWorkloadEndpoint()
+					endpoint.Metadata = api.WorkloadEndpointMetadata{
+						Node:         hostname,
+						Name:         "eth0",
+						Workload:     fmt.Sprintf("test.%s", name),
+						Orchestrator: "k8s",
+						Labels:       map[string]string{"calico/k8s_ns": "test"},
+					}
+					endpoint.Spec.IPNetworks = []cnet.IPNet{{net.IPNet{IP: net.IPv4(10, 0, 0, 6).To4(), Mask: net.CIDRMask(32, 32)}}}
+					endpoint.Spec.Profiles = []string{"k8s_ns.test"}
+					_, err := calicoClient.WorkloadEndpoints().Create(endpoint)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					expectMTU(mtuNetconf(1400, "k8s"), 1350)
+				})
+
+				It("rejects an out of range MTU before allocating an IP", func() {
+					allocations := func() int {
+						return len(HostLocalAllocations("net1"))
+					}
+					before := allocations()
+
+					_, _, session, _, _, _, _ := CreateContainer(mtuNetconf(50, ""), name)
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).ShouldNot(Equal(0))
+					Expect(string(session.Out.Contents())).Should(ContainSubstring("Invalid MTU 50"))
+					Expect(allocations()).Should(Equal(before))
+				})
+			})
+
+			Context("when the endpoint already exists", func() {
+				var name string
+				var clientset *kubernetes.Clientset
+				staleLabels := map[string]string{"calico/k8s_ns": "test", "app": "old"}
+				existingIP := cnet.IPNet{net.IPNet{IP: net.IPv4(10, 0, 0, 5).To4(), Mask: net.CIDRMask(32, 32)}}
+
+				BeforeEach(func() {
+					config, err := clientcmd.DefaultClientConfig.ClientConfig()
+					Expect(err).ShouldNot(HaveOccurred())
+					clientset, err = kubernetes.NewForConfig(config)
+					Expect(err).ShouldNot(HaveOccurred())
+
+					// Create the pod with labels that differ from the ones on the endpoint.
+					name = fmt.Sprintf("run%d", rand.Uint32())
+					_, err = clientset.Pods(K8S_TEST_NS).Create(&v1.Pod{
+						ObjectMeta: v1.ObjectMeta{Name: name, Labels: map[string]string{"app": "new"}},
+						Spec: v1.PodSpec{Containers: []v1.Container{{
+							Name:  fmt.Sprintf("container-%s", name),
+							Image: "ignore",
+						}}},
+					})
+					Expect(err).ShouldNot(HaveOccurred())
+
+					// Simulate a restart by creating the endpoint as a previous ADD would have.
+					endpoint := api.NewWorkloadEndpoint()
+					endpoint.Metadata = api.WorkloadEndpointMetadata{
+						Node:         hostname,
+						Name:         "eth0",
+						Workload:     fmt.Sprintf("test.%s", name),
+						Orchestrator: "k8s",
+						Labels:       staleLabels,
+					}
+					endpoint.Spec.IPNetworks = []cnet.IPNet{existingIP}
+					endpoint.Spec.Profiles = []string{"k8s_ns.test"}
+					_, err = calicoClient.WorkloadEndpoints().Create(endpoint)
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+
+				It("refreshes the labels from Kubernetes", func() {
+					_, netnspath, session, _, _, _, err := CreateContainer(netconf, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).Should(Equal(0))
+
+					endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(endpoints.Items).Should(HaveLen(1))
+					Expect(endpoints.Items[0].Metadata.Labels).Should(Equal(map[string]string{
+						"calico/k8s_ns": "test",
+						"app":           "new",
+					}))
+					Expect(endpoints.Items[0].Spec.IPNetworks).Should(Equal([]cnet.IPNet{existingIP}))
+
+					_, err = DeleteContainer(netconf, netnspath, name)
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+
+				It("keeps the existing labels if Kubernetes is unreachable", func() {
+					// Nothing listens on port 1, so connections to the API root are refused.
+					unreachableNetconf := fmt.Sprintf(`
+					{
+					  "name": "net1",
+					  "type": "calico",
+					  "etcd_endpoints": "http://%s:2379",
+					  "ipam": {
+					    "type": "host-local",
+					    "subnet": "10.0.0.0/8"
+					  },
+					  "kubernetes": {
+					    "k8s_api_root": "http://127.0.0.1:1"
+					  },
+					  "policy": {"type": "k8s"},
+					  "log_level":"info"
+					}`, os.Getenv("ETCD_IP"))
+
+					_, netnspath, session, _, _, _, err := CreateContainer(unreachableNetconf, name)
+					Expect(err).ShouldNot(HaveOccurred())
+					Eventually(session).Should(gexec.Exit())
+					Expect(session.ExitCode()).Should(Equal(0))
+
+					endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(endpoints.Items).Should(HaveLen(1))
+					Expect(endpoints.Items[0].Metadata.Labels).Should(Equal(staleLabels))
+
+					_, err = DeleteContainer(netconf, netnspath, name)
+					Expect(err).ShouldNot(HaveOccurred())
+				})
+			})
+		})
+
+		Context("using calico IPAM", func() {
+			netconf := fmt.Sprintf(`
+			{
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "ipam": {
+			    "type": "calico-ipam"
+			  },
+			  "kubernetes": {
+			    "k8s_api_root": "http://127.0.0.1:8080"
+			  },
+			  "policy": {"type": "k8s"},
+			  "log_level":"info"
+			}`, os.Getenv("ETCD_IP"))
+
+			BeforeEach(func() {
+				testutils.CreateNewIPPool(*calicoClient, "192.168.0.0/16", false, false, true)
+			})
+
+			It("cleans up every sandbox of a deleted pod", func() {
+				config, err := clientcmd.DefaultClientConfig.ClientConfig()
+				Expect(err).ShouldNot(HaveOccurred())
+				clientset, err := kubernetes.NewForConfig(config)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				name := fmt.Sprintf("run%d", rand.Uint32())
+				_, err = clientset.Pods(K8S_TEST_NS).Create(&v1.Pod{
+					ObjectMeta: v1.ObjectMeta{Name: name},
+					Spec: v1.PodSpec{Containers: []v1.Container{{
+						Name:  fmt.Sprintf("container-%s", name),
+						Image: "ignore",
+					}}},
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				containerID, _, session, _, _, _, err := CreateContainer(netconf, name)
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+				Expect(session.ExitCode()).Should(Equal(0))
+
+				result := types020.Result{}
+				Expect(json.Unmarshal(session.Out.Contents(), &result)).To(Succeed())
+
+				// Leave behind the state of an older sandbox for the same pod, holding the same IP.
+				stateFile := fmt.Sprintf("/var/lib/cni/calico/test.%s_%s.json", name, containerID)
+				data, err := ioutil.ReadFile(stateFile)
+				Expect(err).ShouldNot(HaveOccurred())
+				state := utils.WorkloadState{}
+				Expect(json.Unmarshal(data, &state)).To(Succeed())
+				state.ContainerID = "oldsandbox"
+				state.Created = state.Created.Add(-time.Minute)
+				Expect(utils.WriteWorkloadState(utils.NetConf{}, state)).To(Succeed())
+				oldStateFile := fmt.Sprintf("/var/lib/cni/calico/test.%s_oldsandbox.json", name)
+
+				Expect(clientset.Pods(K8S_TEST_NS).Delete(name, &v1.DeleteOptions{})).To(Succeed())
+
+				// Releasing the IP for one state must not stop the other from being cleaned up.
+				session, err = RunCleanup(netconf, "0s")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session, 10).Should(gexec.Exit(0))
+
+				_, err = os.Stat(stateFile)
+				Expect(os.IsNotExist(err)).Should(BeTrue())
+				_, err = os.Stat(oldStateFile)
+				Expect(os.IsNotExist(err)).Should(BeTrue())
+
+				endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(endpoints.Items).Should(HaveLen(0))
+
+				// The IP has been released, so releasing it again reports it as unallocated.
+				ip := cnet.IP{IP: result.IP4.IP.IP}
+				unallocated, err := calicoClient.IPAM().ReleaseIPs([]cnet.IP{ip})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(unallocated).Should(HaveLen(1))
+			})
 		})
 	})
 })
@@ -10,7 +10,8 @@ import (
 	"syscall"
 
 	"github.com/containernetworking/cni/pkg/ns"
-	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
@@ -64,7 +65,7 @@ var _ = Describe("CalicoCni", func() {
 				Expect(err).ShouldNot(HaveOccurred())
 				Eventually(session).Should(gexec.Exit())
 
-				result := types.Result{}
+				result := types020.Result{}
 				if err := json.Unmarshal(session.Out.Contents(), &result); err != nil {
 					panic(err)
 				}
@@ -153,5 +154,92 @@ var _ = Describe("CalicoCni", func() {
 
 			})
 		})
+
+		Context("using host-local IPAM with a gateway and routes", func() {
+			netconf := fmt.Sprintf(`
+			{
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8",
+			    "gateway": "10.0.0.1",
+			    "routes": [{"dst": "10.100.0.0/16"}]
+			  }
+			}`, os.Getenv("ETCD_IP"))
+
+			It("prints the same legacy result as earlier releases", func() {
+				_, netnspath, session, _, _, _, err := CreateContainer(netconf, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+
+				result := types020.Result{}
+				if err := json.Unmarshal(session.Out.Contents(), &result); err != nil {
+					panic(err)
+				}
+
+				// This is the output of the plugin before it supported CNI 0.3.0 results, byte for byte.
+				Expect(string(session.Out.Contents())).Should(Equal(fmt.Sprintf(`{
+    "ip4": {
+        "ip": "%s",
+        "gateway": "10.0.0.1",
+        "routes": [
+            {
+                "dst": "10.100.0.0/16"
+            }
+        ]
+    },
+    "dns": {}
+}`, result.IP4.IP.String())))
+
+				session, err = DeleteContainer(netconf, netnspath, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+			})
+		})
+
+		Context("using a CNI 0.3.0 network config", func() {
+			netconf := fmt.Sprintf(`
+			{
+			  "cniVersion": "0.3.0",
+			  "name": "net1",
+			  "type": "calico",
+			  "etcd_endpoints": "http://%s:2379",
+			  "ipam": {
+			    "type": "host-local",
+			    "subnet": "10.0.0.0/8"
+			  }
+			}`, os.Getenv("ETCD_IP"))
+
+			It("returns the interfaces and routes in the result", func() {
+				containerID, netnspath, session, contVeth, _, _, err := CreateContainer(netconf, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+
+				result := current.Result{}
+				if err := json.Unmarshal(session.Out.Contents(), &result); err != nil {
+					panic(err)
+				}
+
+				hostVeth, err := netlink.LinkByName("cali" + containerID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Interfaces).Should(Equal([]*current.Interface{
+					{Name: "cali" + containerID, Mac: hostVeth.Attrs().HardwareAddr.String()},
+					{Name: "eth0", Mac: contVeth.Attrs().HardwareAddr.String(), Sandbox: netnspath},
+				}))
+				Expect(result.IPs).Should(HaveLen(1))
+				Expect(result.IPs[0].Version).Should(Equal("4"))
+				Expect(result.IPs[0].Interface).Should(Equal(1))
+				Expect(result.IPs[0].Address.Mask.String()).Should(Equal("ffffffff"))
+				Expect(result.Routes).Should(HaveLen(1))
+				Expect(result.Routes[0].Dst.String()).Should(Equal("0.0.0.0/0"))
+				Expect(result.Routes[0].GW.String()).Should(Equal("169.254.1.1"))
+
+				session, err = DeleteContainer(netconf, netnspath, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Eventually(session).Should(gexec.Exit())
+			})
+		})
 	})
 })
@@ -21,10 +21,10 @@ import (
 
 	"os"
 
-	log "github.com/Sirupsen/logrus"
-
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/client"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
@@ -52,7 +52,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	skel.PluginMain(cmdAdd, cmdDel)
+	skel.PluginMain(cmdAdd, cmdDel, version.All)
 }
 
 type ipamArgs struct {
@@ -84,7 +84,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	r := &types.Result{}
+	r := &current.Result{}
 	if ipamArgs.IP != nil {
 		fmt.Fprintf(os.Stderr, "Calico CNI IPAM request IP: %v\n", ipamArgs.IP)
 
@@ -97,8 +97,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 
 		ipV4Network := net.IPNet{IP: ipamArgs.IP, Mask: net.CIDRMask(32, 32)}
-		r.IP4 = &types.IPConfig{IP: ipV4Network}
-		logger.WithField("result.IP4", r.IP4).Info("Result IPv4")
+		r.IPs = append(r.IPs, &current.IPConfig{Version: "4", Address: ipV4Network})
+		logger.WithField("result.IPs", r.IPs).Info("Result IPv4")
 	} else {
 		// Default to assigning an IPv4 address
 		num4 := 1
@@ -127,7 +127,7 @@ func cmdAdd(args *skel.CmdArgs) error {
 				return fmt.Errorf("Failed to request %d IPv4 addresses. IPAM allocated only %d.", num4, len(assignedV4))
 			}
 			ipV4Network := net.IPNet{IP: assignedV4[0].IP, Mask: net.CIDRMask(32, 32)}
-			r.IP4 = &types.IPConfig{IP: ipV4Network}
+			r.IPs = append(r.IPs, &current.IPConfig{Version: "4", Address: ipV4Network})
 		}
 
 		if num6 == 1 {
@@ -135,12 +135,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 				return fmt.Errorf("Failed to request %d IPv6 addresses. IPAM allocated only %d.", num6, len(assignedV6))
 			}
 			ipV6Network := net.IPNet{IP: assignedV6[0].IP, Mask: net.CIDRMask(128, 128)}
-			r.IP6 = &types.IPConfig{IP: ipV6Network}
+			r.IPs = append(r.IPs, &current.IPConfig{Version: "6", Address: ipV6Network})
 		}
-		logger.WithFields(log.Fields{"result.IP4": r.IP4, "result.IP6": r.IP6}).Info("IPAM Result")
+		logger.WithField("result.IPs", r.IPs).Info("IPAM Result")
 	}
 
-	return r.Print()
+	return utils.PrintResult(r, r.Routes, conf.CNIVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -0,0 +1,280 @@
+// Copyright 2015 Tigera Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ipam"
+	"github.com/projectcalico/cni-plugin/utils"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	calicoclient "github.com/projectcalico/libcalico-go/lib/client"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"k8s.io/client-go/kubernetes"
+	k8serrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Cleanup finds workloads on this node that were left behind by an ADD or DEL that never completed, and releases
+// their IP allocations and deletes their endpoints. A workload is orphaned if its pod no longer exists or is now bound
+// to another node. A workload's state is also stale if the pod has been recreated since the state was written, if a
+// newer sandbox has replaced it, or if its IPs aren't the ones on the workload's endpoint. Only state older than
+// minAge is considered so that in-progress ADDs are left alone.
+func Cleanup(conf utils.NetConf, hostname string, calicoClient *calicoclient.Client, minAge time.Duration) error {
+	logger := log.WithField("Node", hostname)
+
+	states, err := utils.ListWorkloadStates(conf)
+	if err != nil {
+		return err
+	}
+	logger.WithField("count", len(states)).Info("Checking workloads for orphans")
+
+	client, err := newK8sClient(conf, logger)
+	if err != nil {
+		return err
+	}
+	nodeName := k8sNodeName(conf, hostname)
+
+	// A workload can have state for several sandboxes if an old one was never cleaned up. Only the newest one can
+	// still be in use.
+	newest := map[string]time.Time{}
+	for _, state := range states {
+		if state.Created.After(newest[state.Workload]) {
+			newest[state.Workload] = state.Created
+		}
+	}
+
+	failed := 0
+	for _, state := range states {
+		wlogger := logger.WithFields(log.Fields{
+			"Workload":    state.Workload,
+			"ContainerID": state.ContainerID,
+		})
+
+		if time.Since(state.Created) < minAge {
+			wlogger.Debug("Skipping recently created workload")
+			continue
+		}
+
+		pod, endpoint, err := checkWorkload(client, calicoClient, hostname, state, wlogger)
+		if err != nil {
+			// Don't guess whether the workload is orphaned if it couldn't be checked.
+			wlogger.WithError(err).Warn("Failed to check workload")
+			failed++
+			continue
+		}
+
+		if pod == nil {
+			wlogger.WithField("endpointExists", endpoint != nil).Info("Cleaning up workload for deleted pod")
+			err = cleanupWorkload(conf, calicoClient, state, endpoint, wlogger)
+		} else if pod.Spec.NodeName != "" && pod.Spec.NodeName != nodeName {
+			// The pod has been recreated with the same name on another node, so nothing on this node is in use.
+			wlogger.WithFields(log.Fields{
+				"podNode":        pod.Spec.NodeName,
+				"endpointExists": endpoint != nil,
+			}).Info("Cleaning up workload for pod on another node")
+			err = cleanupWorkload(conf, calicoClient, state, endpoint, wlogger)
+		} else {
+			samePod := state.PodUID == "" || state.PodUID == string(pod.UID)
+			superseded := state.Created.Before(newest[state.Workload])
+			if samePod && !superseded && endpoint != nil && sameIPs(state.IPs, endpoint.Spec.IPNetworks) {
+				wlogger.Debug("Workload is in use")
+				continue
+			}
+
+			wlogger.WithFields(log.Fields{
+				"samePod":        samePod,
+				"superseded":     superseded,
+				"endpointExists": endpoint != nil,
+			}).Info("Cleaning up stale workload state for live pod")
+			err = cleanupStaleState(conf, calicoClient, state, endpoint, wlogger)
+		}
+		if err != nil {
+			wlogger.WithError(err).Warn("Failed to clean up orphaned workload")
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to check or clean up %d of %d workloads", failed, len(states))
+	}
+	return nil
+}
+
+// checkWorkload returns the workload's pod if it still exists in Kubernetes, and the workload's endpoint on this
+// node if there is one.
+func checkWorkload(client *kubernetes.Clientset, calicoClient *calicoclient.Client, hostname string, state utils.WorkloadState, logger *log.Entry) (*v1.Pod, *api.WorkloadEndpoint, error) {
+	var pod *v1.Pod
+	err := retryK8s(logger, "getting pod", retryMaxAttempts, func() (err error) {
+		pod, err = client.Pods(state.PodNamespace).Get(state.PodName)
+		return err
+	})
+	if k8serrors.IsNotFound(err) {
+		pod = nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	endpoints, err := calicoClient.WorkloadEndpoints().List(api.WorkloadEndpointMetadata{
+		Name:         state.IfName,
+		Node:         hostname,
+		Orchestrator: "k8s",
+		Workload:     state.Workload})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var endpoint *api.WorkloadEndpoint
+	if len(endpoints.Items) == 1 {
+		endpoint = &endpoints.Items[0]
+	}
+	return pod, endpoint, nil
+}
+
+// cleanupWorkload cleans up after a pod that no longer exists on this node. It releases the IPs recorded in the state
+// and held by the endpoint, deletes the endpoint and finally removes the state file.
+func cleanupWorkload(conf utils.NetConf, calicoClient *calicoclient.Client, state utils.WorkloadState, endpoint *api.WorkloadEndpoint, logger *log.Entry) error {
+	ipNets := append([]cnet.IPNet{}, state.IPs...)
+	if endpoint != nil {
+		for _, ipNet := range endpoint.Spec.IPNetworks {
+			if !containsIPNet(ipNets, ipNet) {
+				ipNets = append(ipNets, ipNet)
+			}
+		}
+	}
+
+	logger.WithField("IPs", ipNets).Info("Releasing IP allocation")
+	if err := releaseIPs(calicoClient, state, ipNets, logger); err != nil {
+		return err
+	}
+
+	if endpoint != nil {
+		logger.Info("Deleting endpoint")
+		if err := calicoClient.WorkloadEndpoints().Delete(endpoint.Metadata); err != nil {
+			if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
+				return err
+			}
+		}
+	}
+
+	return utils.RemoveWorkloadState(conf, state.Workload, state.ContainerID)
+}
+
+// cleanupStaleState cleans up state that's no longer in use by a pod that still exists (possibly a new pod with the
+// same name). The pod's endpoint is left alone, as are any IPs it holds. calico-ipam releases by handle, which is
+// shared by every pod with the same name, so its IPs are released individually. Other IPAM plugins are only called if
+// none of the IPs are in use, since they may release everything allocated to the workload.
+func cleanupStaleState(conf utils.NetConf, calicoClient *calicoclient.Client, state utils.WorkloadState, endpoint *api.WorkloadEndpoint, logger *log.Entry) error {
+	var inUse []cnet.IPNet
+	if endpoint != nil {
+		inUse = endpoint.Spec.IPNetworks
+	}
+
+	stale := []cnet.IPNet{}
+	for _, ipNet := range state.IPs {
+		if !containsIPNet(inUse, ipNet) {
+			stale = append(stale, ipNet)
+		}
+	}
+
+	switch {
+	case len(stale) == 0:
+		logger.Info("All IPs are in use by the endpoint, not releasing any")
+	case state.IPAMType == "calico-ipam":
+		logger.WithField("IPs", stale).Info("Releasing stale IPs")
+		if err := releaseIPs(calicoClient, state, stale, logger); err != nil {
+			return err
+		}
+	case len(stale) == len(state.IPs):
+		logger.WithField("IPs", state.IPs).Info("Releasing IP allocation")
+		if err := execIPAMDel(state); err != nil {
+			return err
+		}
+	default:
+		logger.WithField("IPs", stale).Warnf("Some IPs are in use by the endpoint, not calling %s", state.IPAMType)
+	}
+
+	return utils.RemoveWorkloadState(conf, state.Workload, state.ContainerID)
+}
+
+// releaseIPs releases the given IPs from the state's IPAM plugin. calico-ipam's DEL releases by handle, which is
+// shared with any other pod with the same name and fails once the handle has gone, so its IPs are released
+// individually instead. Releasing an IP that's already been released isn't an error. Other IPAM plugins are called
+// to release whatever they allocated to the state's container.
+func releaseIPs(calicoClient *calicoclient.Client, state utils.WorkloadState, ipNets []cnet.IPNet, logger *log.Entry) error {
+	if state.IPAMType != "calico-ipam" {
+		return execIPAMDel(state)
+	}
+
+	ips := []cnet.IP{}
+	for _, ipNet := range ipNets {
+		ips = append(ips, cnet.IP{IP: ipNet.IP})
+	}
+	unallocated, err := calicoClient.IPAM().ReleaseIPs(ips)
+	if err != nil {
+		return err
+	}
+	if len(unallocated) > 0 {
+		logger.WithField("IPs", unallocated).Debug("IPs were already released")
+	}
+	return nil
+}
+
+// execIPAMDel calls the IPAM plugin to release the allocation recorded in the state.
+func execIPAMDel(state utils.WorkloadState) error {
+	// The IPAM plugin reads its arguments from the environment, so recreate the environment of the original ADD.
+	env := map[string]string{
+		"CNI_COMMAND":     "DEL",
+		"CNI_CONTAINERID": state.ContainerID,
+		"CNI_NETNS":       state.Netns,
+		"CNI_IFNAME":      state.IfName,
+		"CNI_ARGS":        state.CNIArgs,
+	}
+	if state.CNIPath != "" {
+		env["CNI_PATH"] = state.CNIPath
+	}
+	for key, value := range env {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return ipam.ExecDel(state.IPAMType, state.StdinData)
+}
+
+// sameIPs returns whether the two lists hold the same IPs, ignoring order.
+func sameIPs(a, b []cnet.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ipNet := range a {
+		if !containsIPNet(b, ipNet) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsIPNet returns whether the list holds the given IP.
+func containsIPNet(ipNets []cnet.IPNet, ipNet cnet.IPNet) bool {
+	for _, other := range ipNets {
+		if other.IP.Equal(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -15,14 +15,21 @@ package k8s
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"os"
 
 	"github.com/containernetworking/cni/pkg/ipam"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/projectcalico/cni-plugin/utils"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	k8sbackend "github.com/projectcalico/libcalico-go/lib/backend/k8s"
@@ -31,6 +38,9 @@ import (
 	"encoding/json"
 
 	"k8s.io/client-go/kubernetes"
+	k8serrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	log "github.com/Sirupsen/logrus"
@@ -40,21 +50,30 @@ import (
 // CmdAddK8s performs the "ADD" operation on a kubernetes pod
 // Having kubernetes code in its own file avoids polluting the mainline code. It's expected that the kubernetes case will
 // more special casing than the mainline code.
-func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, hostname string, calicoClient *calicoclient.Client, endpoint *api.WorkloadEndpoint) (*types.Result, error) {
+// The routes returned by IPAM are returned alongside the result since they're all the legacy result format includes.
+func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, hostname string, calicoClient *calicoclient.Client, endpoint *api.WorkloadEndpoint) (*current.Result, []*types.Route, error) {
 	var err error
-	var result *types.Result
+	var result *current.Result
+
+	// The pod's annotations and UID are only available when the pod has been fetched from Kubernetes (i.e. when
+	// the policy type is "k8s").
+	var annotations map[string]string
+	var podUID string
+
+	// Remember whether the endpoint already existed since its IPs mustn't be released if the ADD fails.
+	existingEndpoint := endpoint != nil
 
 	k8sArgs := utils.K8sArgs{}
 	err = types.LoadArgs(args.Args, &k8sArgs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	utils.ConfigureLogging(conf.LogLevel)
 
 	workload, orchestrator, err := utils.GetIdentifiers(args)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	logger := utils.CreateContextLogger(workload)
 	logger.WithFields(log.Fields{
@@ -69,45 +88,67 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, hostname string, calicoCl
 		// and use that in the response.
 		result, err = utils.CreateResultFromEndpoint(endpoint)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		logger.WithField("result", result).Debug("Created result from existing endpoint")
-		// If any labels changed whilst the container was being restarted, they will be picked up by the policy
-		// controller so there's no need to update the labels here.
+
+		// Labels may have changed whilst the container was being restarted, so refresh them (and the profile)
+		// from Kubernetes. The API may not be reachable yet if the whole node is recovering, so any failure is
+		// logged and the existing labels are kept rather than failing the ADD.
+		if conf.Policy.PolicyType == "k8s" {
+			if pod := updateExistingEndpoint(conf, k8sArgs, endpoint, logger); pod != nil {
+				annotations = pod.Annotations
+				podUID = string(pod.UID)
+			}
+		}
 	} else {
 		client, err := newK8sClient(conf, logger)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		logger.WithField("client", client).Debug("Created Kubernetes client")
 
-		if conf.IPAM.Type == "host-local" && strings.EqualFold(conf.IPAM.Subnet, "usePodCidr") {
+		usePodCidr := conf.IPAM.Type == "host-local" && strings.EqualFold(conf.IPAM.Subnet, "usePodCidr")
+		podCidrCached := false
+		if usePodCidr {
 			// We've been told to use the "host-local" IPAM plugin with the Kubernetes podCidr for this node.
-			// Replace the actual value in the args.StdinData as that's what's passed to the IPAM plugin.
+			// The podCidr is cached locally so that pods can still be networked when the API server is down.
 			fmt.Fprintf(os.Stderr, "Calico CNI fetching podCidr from Kubernetes\n")
-			var stdinData map[string]interface{}
-			if err := json.Unmarshal(args.StdinData, &stdinData); err != nil {
-				return nil, err
-			}
-			podCidr, err := getPodCidr(client, conf, hostname)
+			var podCidr string
+			podCidr, podCidrCached, err = getCachedPodCidr(client, conf, hostname, logger)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			logger.WithField("podCidr", podCidr).Info("Fetched podCidr")
-			stdinData["ipam"].(map[string]interface{})["subnet"] = podCidr
-			fmt.Fprintf(os.Stderr, "Calico CNI passing podCidr to host-local IPAM: %s\n", podCidr)
-			args.StdinData, err = json.Marshal(stdinData)
-			if err != nil {
-				return nil, err
+			logger.WithFields(log.Fields{"podCidr": podCidr, "cached": podCidrCached}).Info("Fetched podCidr")
+			if err = setPodCidr(args, podCidr, logger); err != nil {
+				return nil, nil, err
 			}
-			logger.WithField("stdin", args.StdinData).Debug("Updated stdin data")
 		}
 
 		// Run the IPAM plugin
 		logger.Debugf("Calling IPAM plugin %s", conf.IPAM.Type)
-		result, err = ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+		var ipamResult types.Result
+		ipamResult, err = ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+		if err != nil && podCidrCached {
+			// The cached podCidr may be stale. Refetch it from Kubernetes and try once more before giving up.
+			logger.WithError(err).Warn("IPAM failed using cached podCidr, refetching from Kubernetes")
+			var podCidr string
+			if podCidr, err = refreshPodCidr(client, conf, hostname, logger); err != nil {
+				return nil, nil, err
+			}
+			if err = setPodCidr(args, podCidr, logger); err != nil {
+				return nil, nil, err
+			}
+			ipamResult, err = ipam.ExecAdd(conf.IPAM.Type, args.StdinData)
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+
+		// Convert the IPAM result into the current result format, whatever version the IPAM plugin returned.
+		if result, err = current.NewResultFromResult(ipamResult); err != nil {
+			utils.ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
+			return nil, nil, err
 		}
 		logger.Debugf("IPAM plugin returned: %+v", result)
 
@@ -122,51 +163,96 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, hostname string, calicoCl
 		// Set the profileID according to whether Kubernetes policy is required.
 		// If it's not, then just use the network name (which is the normal behavior)
 		// otherwise use one based on the Kubernetes pod's Namespace.
+		// The extra profiles from the network config apply either way.
 		if conf.Policy.PolicyType == "k8s" {
 			endpoint.Spec.Profiles = []string{fmt.Sprintf("k8s_ns.%s", k8sArgs.K8S_POD_NAMESPACE)}
 		} else {
-			endpoint.Spec.Profiles = []string{conf.Name}
+			endpoint.Spec.Profiles = uniqueProfiles(append([]string{conf.Name}, conf.Policy.ExtraProfiles...))
 		}
 
 		// Populate the endpoint with the output from the IPAM plugin.
 		if err = utils.PopulateEndpointNets(endpoint, result); err != nil {
 			// Cleanup IP allocation and return the error.
 			utils.ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
-			return nil, err
+			return nil, nil, err
 		}
 		logger.WithField("endpoint", endpoint).Info("Populated endpoint")
 
 		// Only attempt to fetch the labels from Kubernetes if the policy type has been set to "k8s"
 		// This allows users to run the plugin under Kubernetes without needing it to access the Kubernetes API
 		if conf.Policy.PolicyType == "k8s" {
-			labels, err := getK8sLabels(client, k8sArgs)
+			labels, pod, err := getK8sLabels(client, k8sArgs, retryMaxAttempts, logger)
 			if err != nil {
 				// Cleanup IP allocation and return the error.
 				utils.ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
-				return nil, err
+				return nil, nil, err
 			}
 			logger.WithField("labels", labels).Info("Fetched K8s labels")
 			endpoint.Metadata.Labels = labels
+			annotations = pod.Annotations
+			podUID = string(pod.UID)
+			endpoint.Spec.Profiles = getK8sProfiles(conf, k8sArgs, annotations)
 		}
 	}
 	fmt.Fprintf(os.Stderr, "Calico CNI using IPs: %s\n", endpoint.Spec.IPNetworks)
 
+	// Record what's been allocated for this workload so that it can be cleaned up if the ADD never completes or the
+	// pod goes away without a DEL.
+	state := utils.WorkloadState{
+		Workload:     workload,
+		ContainerID:  args.ContainerID,
+		IfName:       args.IfName,
+		Netns:        args.Netns,
+		PodNamespace: string(k8sArgs.K8S_POD_NAMESPACE),
+		PodName:      string(k8sArgs.K8S_POD_NAME),
+		PodUID:       podUID,
+		IPAMType:     conf.IPAM.Type,
+		IPs:          endpoint.Spec.IPNetworks,
+		CNIArgs:      os.Getenv("CNI_ARGS"),
+		CNIPath:      os.Getenv("CNI_PATH"),
+		StdinData:    args.StdinData,
+		Created:      time.Now(),
+	}
+	if err = utils.WriteWorkloadState(conf, state); err != nil {
+		logger.WithError(err).Warn("Failed to write workload state")
+	}
+
+	// Allow the MTU from the network config to be overridden on a per pod basis.
+	if conf.Policy.PolicyType != "k8s" {
+		logger.Infof("Policy type isn't \"k8s\" so the pod isn't fetched and any %s annotation is ignored", mtuAnnotation)
+	}
+	if mtu, err := getMTU(annotations, conf.MTU); err != nil {
+		if !existingEndpoint {
+			// Cleanup IP allocation and return the error.
+			releaseFailedAdd(logger, conf, args, workload)
+			return nil, nil, err
+		}
+		// The IPs are still held by the existing endpoint, so don't release them over a bad annotation.
+		logger.WithError(err).Warnf("Ignoring MTU annotation on existing endpoint, using MTU %d", conf.MTU)
+	} else {
+		conf.MTU = mtu
+	}
+	logger.WithField("mtu", conf.MTU).Debug("Using MTU")
+
+	// DoNetworking adds its own routes to the result, so keep hold of the ones from IPAM.
+	ipamRoutes := append([]*types.Route{}, result.Routes...)
+
 	// Whether the endpoint existed or not, the veth needs (re)creating.
 	hostVethName := k8sbackend.VethNameForWorkload(workload)
 	_, contVethMac, err := utils.DoNetworking(args, conf, result, logger, hostVethName)
 	if err != nil {
 		// Cleanup IP allocation and return the error.
 		logger.Errorf("Error setting up networking: %s", err)
-		utils.ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
-		return nil, err
+		releaseFailedAdd(logger, conf, args, workload)
+		return nil, nil, err
 	}
 
 	mac, err := net.ParseMAC(contVethMac)
 	if err != nil {
 		// Cleanup IP allocation and return the error.
 		logger.Errorf("Error parsing MAC (%s): %s", contVethMac, err)
-		utils.ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
-		return nil, err
+		releaseFailedAdd(logger, conf, args, workload)
+		return nil, nil, err
 	}
 	endpoint.Spec.MAC = &cnet.MAC{HardwareAddr: mac}
 	endpoint.Spec.InterfaceName = hostVethName
@@ -175,15 +261,82 @@ func CmdAddK8s(args *skel.CmdArgs, conf utils.NetConf, hostname string, calicoCl
 	// Write the endpoint object (either the newly created one, or the updated one)
 	if _, err := calicoClient.WorkloadEndpoints().Apply(endpoint); err != nil {
 		// Cleanup IP allocation and return the error.
-		utils.ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
-		return nil, err
+		releaseFailedAdd(logger, conf, args, workload)
+		return nil, nil, err
 	}
 	logger.Info("Wrote updated endpoint to datastore")
 
-	return result, nil
+	return result, ipamRoutes, nil
 }
 
+// releaseFailedAdd cleans up the IP allocation and workload state for an ADD that failed.
+func releaseFailedAdd(logger *log.Entry, conf utils.NetConf, args *skel.CmdArgs, workload string) {
+	utils.ReleaseIPAllocation(logger, conf.IPAM.Type, args.StdinData)
+	if err := utils.RemoveWorkloadState(conf, workload, args.ContainerID); err != nil {
+		logger.WithError(err).Warn("Failed to remove workload state")
+	}
+}
+
+// updateExistingEndpoint refreshes the labels and profiles on an existing endpoint so that they match the current
+// state of the pod in Kubernetes. Errors are logged rather than returned since the endpoint is still usable with its
+// previous labels and profiles. The pod is returned if it could be fetched.
+func updateExistingEndpoint(conf utils.NetConf, k8sArgs utils.K8sArgs, endpoint *api.WorkloadEndpoint, logger *log.Entry) *v1.Pod {
+	client, err := newK8sClient(conf, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to create Kubernetes client, keeping existing labels")
+		return nil
+	}
+
+	// Only try once, since the existing labels will do and the API server may be down for a while if the whole node
+	// is recovering.
+	labels, pod, err := getK8sLabels(client, k8sArgs, 1, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to fetch K8s labels, keeping existing labels")
+		return nil
+	}
+
+	if !reflect.DeepEqual(endpoint.Metadata.Labels, labels) {
+		logger.WithFields(log.Fields{
+			"old": endpoint.Metadata.Labels,
+			"new": labels,
+		}).Info("Updating labels on existing endpoint")
+		endpoint.Metadata.Labels = labels
+	}
+
+	profiles := getK8sProfiles(conf, k8sArgs, pod.Annotations)
+	if !reflect.DeepEqual(endpoint.Spec.Profiles, profiles) {
+		logger.WithFields(log.Fields{
+			"old": endpoint.Spec.Profiles,
+			"new": profiles,
+		}).Info("Updating profiles on existing endpoint")
+		endpoint.Spec.Profiles = profiles
+	}
+	return pod
+}
+
+// Annotation used to override the MTU of a pod's interfaces. The pod is only fetched from Kubernetes when the
+// policy type is "k8s", so the annotation is ignored for any other policy type.
+const mtuAnnotation = "cni.projectcalico.org/mtu"
+
+// Annotation listing additional (comma separated) profiles to apply to a pod.
+const profilesAnnotation = "cni.projectcalico.org/profiles"
+
+// Location of the service account credentials that Kubernetes mounts into every pod. These are used as a last resort
+// when no other credentials have been configured, mirroring rest.InClusterConfig().
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
 func newK8sClient(conf utils.NetConf, logger *log.Entry) (*kubernetes.Clientset, error) {
+	config, err := k8sClientConfig(conf, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the clientset
+	return kubernetes.NewForConfig(config)
+}
+
+// k8sClientConfig builds the Kubernetes client config from the network config and any kubeconfig file it references.
+func k8sClientConfig(conf utils.NetConf, logger *log.Entry) (*rest.Config, error) {
 	// Some config can be passed in a kubeconfig file
 	kubeconfig := conf.Kubernetes.Kubeconfig
 
@@ -218,6 +371,55 @@ func newK8sClient(conf utils.NetConf, logger *log.Entry) (*kubernetes.Clientset,
 		configOverrides.ClusterInfo.Server = conf.Kubernetes.K8sAPIRoot
 	}
 
+	// Work out where the credentials come from. In order of precedence: credentials passed explicitly in the
+	// network config, a kubeconfig file, a token file, and finally the pod's service account.
+	tokenFile := conf.Policy.K8sAuthTokenFile
+	if conf.Kubernetes.K8sAuthTokenFile != "" {
+		tokenFile = conf.Kubernetes.K8sAuthTokenFile
+	}
+	explicitCreds := conf.Policy.K8sAuthToken != "" || conf.Policy.K8sClientCertificate != "" ||
+		conf.Policy.K8sClientKey != ""
+
+	var source string
+	switch {
+	case explicitCreds:
+		source = "network config"
+	case kubeconfig != "":
+		source = fmt.Sprintf("kubeconfig %s", kubeconfig)
+	case tokenFile != "":
+		// The token is read on every invocation so that rotated tokens are picked up.
+		token, err := readTokenFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		configOverrides.AuthInfo.Token = token
+		source = fmt.Sprintf("token file %s", tokenFile)
+	default:
+		saTokenFile := filepath.Join(serviceAccountDir, "token")
+		if _, err := os.Stat(saTokenFile); err != nil {
+			source = "defaults"
+			break
+		}
+		token, err := readTokenFile(saTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		configOverrides.AuthInfo.Token = token
+		if configOverrides.ClusterInfo.CertificateAuthority == "" {
+			configOverrides.ClusterInfo.CertificateAuthority = filepath.Join(serviceAccountDir, "ca.crt")
+		}
+		if configOverrides.ClusterInfo.Server == "" {
+			host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+			if host == "" || port == "" {
+				return nil, fmt.Errorf("Using in-cluster credentials from %s but KUBERNETES_SERVICE_HOST "+
+					"and KUBERNETES_SERVICE_PORT are not set and no k8s_api_root is configured", serviceAccountDir)
+			}
+			configOverrides.ClusterInfo.Server = "https://" + net.JoinHostPort(host, port)
+		}
+		source = fmt.Sprintf("in-cluster service account %s", serviceAccountDir)
+	}
+	logger.WithField("source", source).Debug("Selected Kubernetes credentials")
+
 	// Use the kubernetes client code to load the kubeconfig file and combine it with the overrides.
 	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
@@ -226,16 +428,35 @@ func newK8sClient(conf utils.NetConf, logger *log.Entry) (*kubernetes.Clientset,
 		return nil, err
 	}
 
+	// Don't let a single request hang the CNI invocation if the API server is unresponsive.
+	config.Timeout = k8sRequestTimeout
+
 	logger.Debugf("Kubernetes config %v", config)
+	return config, nil
+}
 
-	// Create the clientset
-	return kubernetes.NewForConfig(config)
+// readTokenFile returns the bearer token stored in the given file.
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Kubernetes token file %s: %v", path, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Kubernetes token file %s is empty", path)
+	}
+	return token, nil
 }
 
-func getK8sLabels(client *kubernetes.Clientset, k8sargs utils.K8sArgs) (map[string]string, error) {
-	pods, err := client.Pods(string(k8sargs.K8S_POD_NAMESPACE)).Get(fmt.Sprintf("%s", k8sargs.K8S_POD_NAME))
+// getK8sLabels returns the labels of the pod along with the pod itself, making up to maxAttempts attempts to fetch it.
+func getK8sLabels(client *kubernetes.Clientset, k8sargs utils.K8sArgs, maxAttempts int, logger *log.Entry) (map[string]string, *v1.Pod, error) {
+	var pods *v1.Pod
+	err := retryK8s(logger, "getting pod", maxAttempts, func() (err error) {
+		pods, err = client.Pods(string(k8sargs.K8S_POD_NAMESPACE)).Get(fmt.Sprintf("%s", k8sargs.K8S_POD_NAME))
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	labels := pods.Labels
@@ -245,17 +466,69 @@ func getK8sLabels(client *kubernetes.Clientset, k8sargs utils.K8sArgs) (map[stri
 
 	labels["calico/k8s_ns"] = fmt.Sprintf("%s", k8sargs.K8S_POD_NAMESPACE)
 
-	return labels, nil
+	return labels, pods, nil
+}
+
+// getK8sProfiles returns the profiles for a pod. The namespace profile comes first, followed by the extra profiles
+// from the network config and then those listed in the pod's profiles annotation.
+func getK8sProfiles(conf utils.NetConf, k8sArgs utils.K8sArgs, annotations map[string]string) []string {
+	names := []string{fmt.Sprintf("k8s_ns.%s", k8sArgs.K8S_POD_NAMESPACE)}
+	names = append(names, conf.Policy.ExtraProfiles...)
+	if value, ok := annotations[profilesAnnotation]; ok {
+		names = append(names, strings.Split(value, ",")...)
+	}
+	return uniqueProfiles(names)
 }
 
-func getPodCidr(client *kubernetes.Clientset, conf utils.NetConf, hostname string) (string, error) {
+// uniqueProfiles trims the given profile names and drops any that are empty or duplicated, preserving the order.
+func uniqueProfiles(names []string) []string {
+	profiles := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		profiles = append(profiles, name)
+	}
+	return profiles
+}
+
+// getMTU returns the MTU from the pod's MTU annotation if there is one, otherwise the default.
+func getMTU(annotations map[string]string, defaultMTU int) (int, error) {
+	value, ok := annotations[mtuAnnotation]
+	if !ok {
+		return defaultMTU, nil
+	}
+
+	mtu, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s annotation %q: %v", mtuAnnotation, value, err)
+	}
+	if err = utils.ValidateMTU(mtu); err != nil {
+		return 0, fmt.Errorf("Invalid %s annotation: %v", mtuAnnotation, err)
+	}
+	return mtu, nil
+}
+
+// k8sNodeName returns the name of this node in Kubernetes.
+func k8sNodeName(conf utils.NetConf, hostname string) string {
 	// Pull the node name out of the config if it's set. Defaults to hostname
-	nodeName := hostname
 	if conf.Kubernetes.NodeName != "" {
-		nodeName = conf.Kubernetes.NodeName
+		return conf.Kubernetes.NodeName
 	}
+	return hostname
+}
 
-	node, err := client.Nodes().Get(nodeName)
+func getPodCidr(client *kubernetes.Clientset, conf utils.NetConf, hostname string, logger *log.Entry) (string, error) {
+	nodeName := k8sNodeName(conf, hostname)
+
+	var node *v1.Node
+	err := retryK8s(logger, "getting node", retryMaxAttempts, func() (err error) {
+		node, err = client.Nodes().Get(nodeName)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -267,3 +540,117 @@ func getPodCidr(client *kubernetes.Clientset, conf utils.NetConf, hostname strin
 		return node.Spec.PodCIDR, nil
 	}
 }
+
+// Bounds on retrying transient Kubernetes API errors. No retry is started once retryDeadline has passed, and each
+// request is limited to k8sRequestTimeout, so retrying never takes much longer than their sum.
+const (
+	retryMaxAttempts    = 5
+	retryInitialBackoff = 500 * time.Millisecond
+	retryDeadline       = 10 * time.Second
+	k8sRequestTimeout   = 5 * time.Second
+)
+
+// retryK8s calls fn up to maxAttempts times, retrying with exponential backoff if it fails with an error that's
+// likely to be transient. Any other error is returned immediately.
+func retryK8s(logger *log.Entry, operation string, maxAttempts int, fn func() error) error {
+	deadline := time.Now().Add(retryDeadline)
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxAttempts || !isTransientK8sError(err) {
+			return err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			logger.WithError(err).Warnf("Transient Kubernetes API error %s, giving up after %d attempts", operation, attempt)
+			return err
+		}
+		logger.WithError(err).WithFields(log.Fields{
+			"attempt":     attempt,
+			"maxAttempts": maxAttempts,
+			"backoff":     backoff,
+		}).Warnf("Transient Kubernetes API error %s, retrying", operation)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransientK8sError returns true if the error is one that's worth retrying: the API server being temporarily
+// unreachable, timing out, overloaded or failing internally.
+func isTransientK8sError(err error) bool {
+	if status, ok := err.(k8serrors.APIStatus); ok {
+		switch status.Status().Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset")
+}
+
+// podCidrCachePath returns the location of the file used to cache this node's podCidr.
+func podCidrCachePath(conf utils.NetConf) string {
+	if conf.Kubernetes.PodCidrCacheFile != "" {
+		return conf.Kubernetes.PodCidrCacheFile
+	}
+	return filepath.Join("/var/lib/cni/networks", conf.Name, "podcidr")
+}
+
+// getCachedPodCidr returns the podCidr for this node, using the local cache if it's available and only querying
+// Kubernetes when it isn't. The returned bool indicates whether the value came from the cache.
+func getCachedPodCidr(client *kubernetes.Clientset, conf utils.NetConf, hostname string, logger *log.Entry) (string, bool, error) {
+	path := podCidrCachePath(conf)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		podCidr := strings.TrimSpace(string(data))
+		if _, _, err = net.ParseCIDR(podCidr); err == nil {
+			logger.WithField("path", path).Debug("Using cached podCidr")
+			return podCidr, true, nil
+		}
+		logger.WithError(err).Warnf("Ignoring invalid podCidr cache %s", path)
+	} else if !os.IsNotExist(err) {
+		logger.WithError(err).Warnf("Failed to read podCidr cache %s", path)
+	}
+
+	podCidr, err := refreshPodCidr(client, conf, hostname, logger)
+	return podCidr, false, err
+}
+
+// refreshPodCidr fetches the podCidr for this node from Kubernetes and writes it to the local cache. The existing
+// cache is only replaced once the fetch succeeds, so it survives the API server being unavailable. Failing to
+// write the cache isn't fatal since the value can always be fetched again.
+func refreshPodCidr(client *kubernetes.Clientset, conf utils.NetConf, hostname string, logger *log.Entry) (string, error) {
+	podCidr, err := getPodCidr(client, conf, hostname, logger)
+	if err != nil {
+		return "", err
+	}
+
+	path := podCidrCachePath(conf)
+	if err = utils.WriteFileAtomic(path, []byte(podCidr)); err != nil {
+		logger.WithError(err).Warnf("Failed to write podCidr cache %s", path)
+	}
+	return podCidr, nil
+}
+
+// setPodCidr replaces the subnet in the IPAM section of args.StdinData since that's what's passed to the IPAM plugin.
+func setPodCidr(args *skel.CmdArgs, podCidr string, logger *log.Entry) error {
+	var stdinData map[string]interface{}
+	if err := json.Unmarshal(args.StdinData, &stdinData); err != nil {
+		return err
+	}
+	stdinData["ipam"].(map[string]interface{})["subnet"] = podCidr
+	fmt.Fprintf(os.Stderr, "Calico CNI passing podCidr to host-local IPAM: %s\n", podCidr)
+
+	var err error
+	args.StdinData, err = json.Marshal(stdinData)
+	if err != nil {
+		return err
+	}
+	logger.WithField("stdin", args.StdinData).Debug("Updated stdin data")
+	return nil
+}
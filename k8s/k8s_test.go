@@ -0,0 +1,266 @@
+package k8s
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/cni-plugin/utils"
+	"k8s.io/client-go/kubernetes"
+	k8serrors "k8s.io/client-go/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/unversioned"
+	"k8s.io/client-go/rest"
+)
+
+var _ = Describe("podCidr cache", func() {
+	var server *httptest.Server
+	var client *kubernetes.Clientset
+	var conf utils.NetConf
+	var tmpDir string
+	var nodeRequests int
+	var nodeStatus int
+	logger := log.WithField("test", "podCidr")
+
+	BeforeEach(func() {
+		nodeRequests = 0
+		nodeStatus = http.StatusOK
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/nodes/node1" {
+				http.NotFound(w, r)
+				return
+			}
+			nodeRequests++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(nodeStatus)
+			if nodeStatus == http.StatusOK {
+				fmt.Fprint(w, `{"kind": "Node", "apiVersion": "v1", "metadata": {"name": "node1"}, "spec": {"podCIDR": "10.1.2.0/24"}}`)
+			} else {
+				fmt.Fprintf(w, `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "code": %d}`, nodeStatus)
+			}
+		}))
+
+		var err error
+		client, err = kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		tmpDir, err = ioutil.TempDir("", "podcidr")
+		Expect(err).ShouldNot(HaveOccurred())
+		conf = utils.NetConf{Name: "net1"}
+		conf.Kubernetes.PodCidrCacheFile = filepath.Join(tmpDir, "podcidr")
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("fetches and caches the podCidr on a cache miss", func() {
+		podCidr, cached, err := getCachedPodCidr(client, conf, "node1", logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(podCidr).Should(Equal("10.1.2.0/24"))
+		Expect(cached).Should(BeFalse())
+		Expect(nodeRequests).Should(Equal(1))
+
+		data, err := ioutil.ReadFile(conf.Kubernetes.PodCidrCacheFile)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(data)).Should(Equal("10.1.2.0/24"))
+	})
+
+	It("uses the cached podCidr without querying Kubernetes", func() {
+		Expect(ioutil.WriteFile(conf.Kubernetes.PodCidrCacheFile, []byte("10.9.0.0/24\n"), 0644)).To(Succeed())
+
+		podCidr, cached, err := getCachedPodCidr(client, conf, "node1", logger)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(podCidr).Should(Equal("10.9.0.0/24"))
+		Expect(cached).Should(BeTrue())
+		Expect(nodeRequests).Should(Equal(0))
+	})
+
+	It("keeps the cache if refetching the podCidr fails", func() {
+		Expect(ioutil.WriteFile(conf.Kubernetes.PodCidrCacheFile, []byte("10.9.0.0/24"), 0644)).To(Succeed())
+		nodeStatus = http.StatusForbidden
+
+		_, err := refreshPodCidr(client, conf, "node1", logger)
+		Expect(err).Should(HaveOccurred())
+
+		data, err := ioutil.ReadFile(conf.Kubernetes.PodCidrCacheFile)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(string(data)).Should(Equal("10.9.0.0/24"))
+	})
+})
+
+// timeoutError is a net.Error that reports a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func statusError(code int) error {
+	return &k8serrors.StatusError{ErrStatus: unversioned.Status{Status: unversioned.StatusFailure, Code: int32(code)}}
+}
+
+var _ = Describe("isTransientK8sError", func() {
+	DescribeTable("classifies errors",
+		func(err error, expected bool) {
+			Expect(isTransientK8sError(err)).Should(Equal(expected))
+		},
+		Entry("404 Not Found", statusError(http.StatusNotFound), false),
+		Entry("403 Forbidden", statusError(http.StatusForbidden), false),
+		Entry("429 Too Many Requests", statusError(http.StatusTooManyRequests), true),
+		Entry("503 Service Unavailable", statusError(http.StatusServiceUnavailable), true),
+		Entry("connection refused", &url.Error{Op: "Get", URL: "https://10.0.0.1/api/v1/nodes/node1",
+			Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, true),
+		Entry("request timeout", &url.Error{Op: "Get", URL: "https://10.0.0.1/api/v1/nodes/node1",
+			Err: timeoutError{}}, true),
+		Entry("other error", errors.New("something went wrong"), false),
+	)
+})
+
+var _ = Describe("retryK8s", func() {
+	logger := log.WithField("test", "retryK8s")
+
+	It("doesn't retry errors that aren't transient", func() {
+		calls := 0
+		err := retryK8s(logger, "testing", retryMaxAttempts, func() error {
+			calls++
+			return statusError(http.StatusForbidden)
+		})
+		Expect(err).Should(HaveOccurred())
+		Expect(calls).Should(Equal(1))
+	})
+
+	It("retries transient errors until the call succeeds", func() {
+		calls := 0
+		err := retryK8s(logger, "testing", retryMaxAttempts, func() error {
+			calls++
+			if calls < 2 {
+				return statusError(http.StatusServiceUnavailable)
+			}
+			return nil
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(calls).Should(Equal(2))
+	})
+
+	It("makes a single attempt when maxAttempts is 1", func() {
+		calls := 0
+		err := retryK8s(logger, "testing", 1, func() error {
+			calls++
+			return statusError(http.StatusServiceUnavailable)
+		})
+		Expect(err).Should(HaveOccurred())
+		Expect(calls).Should(Equal(1))
+	})
+})
+
+var _ = Describe("Kubernetes credentials", func() {
+	var tmpDir string
+	logger := log.WithField("test", "credentials")
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "k8screds")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	writeFile := func(name, data string) string {
+		path := filepath.Join(tmpDir, name)
+		Expect(ioutil.WriteFile(path, []byte(data), 0600)).To(Succeed())
+		return path
+	}
+
+	Describe("readTokenFile", func() {
+		It("returns the trimmed token", func() {
+			token, err := readTokenFile(writeFile("token", "file-token\n"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(token).Should(Equal("file-token"))
+		})
+
+		It("reports a missing file", func() {
+			path := filepath.Join(tmpDir, "missing")
+			_, err := readTokenFile(path)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(path))
+		})
+
+		It("reports an empty file", func() {
+			path := writeFile("empty", " \n")
+			_, err := readTokenFile(path)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(path))
+			Expect(err.Error()).Should(ContainSubstring("empty"))
+		})
+	})
+
+	Describe("k8sClientConfig", func() {
+		var conf utils.NetConf
+
+		BeforeEach(func() {
+			conf = utils.NetConf{}
+			conf.Kubernetes.K8sAuthTokenFile = writeFile("token", "file-token")
+		})
+
+		It("uses the token file if no other credentials are configured", func() {
+			conf.Kubernetes.K8sAPIRoot = "http://127.0.0.1:8080"
+			config, err := k8sClientConfig(conf, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(config.BearerToken).Should(Equal("file-token"))
+		})
+
+		It("prefers credentials from the network config", func() {
+			conf.Kubernetes.K8sAPIRoot = "http://127.0.0.1:8080"
+			conf.Policy.K8sAuthToken = "config-token"
+			config, err := k8sClientConfig(conf, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(config.BearerToken).Should(Equal("config-token"))
+		})
+
+		It("prefers the kubeconfig file", func() {
+			conf.Kubernetes.Kubeconfig = writeFile("kubeconfig", `
+apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: http://127.0.0.1:8080
+users:
+- name: test
+  user:
+    token: kubeconfig-token
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+`)
+			config, err := k8sClientConfig(conf, logger)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(config.BearerToken).Should(Equal("kubeconfig-token"))
+		})
+
+		It("fails if the token file can't be read", func() {
+			conf.Kubernetes.K8sAPIRoot = "http://127.0.0.1:8080"
+			conf.Kubernetes.K8sAuthTokenFile = filepath.Join(tmpDir, "missing")
+			_, err := k8sClientConfig(conf, logger)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(conf.Kubernetes.K8sAuthTokenFile))
+		})
+	})
+})
@@ -5,6 +5,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -21,6 +23,7 @@ import (
 
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/020"
 	etcdclient "github.com/coreos/etcd/client"
 	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega/gexec"
@@ -70,7 +73,7 @@ func WipeK8sPods() {
 	}
 }
 
-func RunIPAMPlugin(netconf, command, args string) (types.Result, int) {
+func RunIPAMPlugin(netconf, command, args string) (types020.Result, int) {
 	conf := types.NetConf{}
 	if err := json.Unmarshal([]byte(netconf), &conf); err != nil {
 		panic(fmt.Errorf("failed to load netconf: %v", err))
@@ -96,7 +99,7 @@ func RunIPAMPlugin(netconf, command, args string) (types.Result, int) {
 	}
 	session.Wait(5)
 	exitCode := session.ExitCode()
-	result := types.Result{}
+	result := types020.Result{}
 	stdout := session.Out.Contents()
 	if exitCode == 0 {
 
@@ -203,6 +206,35 @@ func DeleteContainer(netconf, netnspath, name string) (session *gexec.Session, e
 	return
 }
 
+// HostLocalAllocations returns the IPs that the host-local IPAM plugin has allocated on the given network.
+func HostLocalAllocations(network string) []string {
+	files, _ := ioutil.ReadDir(path.Join("/var/lib/cni/networks", network))
+	ips := []string{}
+	for _, file := range files {
+		// host-local also keeps track of the last IP it reserved, so only count the files named after an IP.
+		if net.ParseIP(file.Name()) != nil {
+			ips = append(ips, file.Name())
+		}
+	}
+	return ips
+}
+
+// RunCleanup runs the plugin's orphan cleanup with the supplied netconf, only considering workloads older than minAge.
+func RunCleanup(netconf, minAge string) (session *gexec.Session, err error) {
+	subProcess := exec.Command(fmt.Sprintf("dist/%s", os.Getenv("PLUGIN")), "-gc", "-gc-min-age", minAge)
+	stdin, err := subProcess.StdinPipe()
+	if err != nil {
+		panic("some error found")
+	}
+
+	io.WriteString(stdin, netconf)
+	io.WriteString(stdin, "\n")
+	stdin.Close()
+
+	session, err = gexec.Start(subProcess, ginkgo.GinkgoWriter, ginkgo.GinkgoWriter)
+	return
+}
+
 func Cmd(cmd string) string {
 	ginkgo.GinkgoWriter.Write([]byte(fmt.Sprintf("Running command [%s]\n", cmd)))
 	out, err := exec.Command("bash", "-c", cmd).Output()
@@ -2,18 +2,25 @@ package utils
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/vishvananda/netlink"
 )
 
 // DoNetworking performs the networking for the given config and IPAM result
-func DoNetworking(args *skel.CmdArgs, conf NetConf, res *types.Result, logger *log.Entry, desiredVethName string) (hostVethName, contVethMAC string, err error) {
+func DoNetworking(args *skel.CmdArgs, conf NetConf, res *current.Result, logger *log.Entry, desiredVethName string) (hostVethName, contVethMAC string, err error) {
 	// Select the first 11 characters of the containerID for the host veth.
 	hostVethName = "cali" + args.ContainerID[:min(11, len(args.ContainerID))]
 	contVethName := args.IfName
@@ -44,6 +51,13 @@ func DoNetworking(args *skel.CmdArgs, conf NetConf, res *types.Result, logger *l
 			return err
 		}
 
+		// The peer doesn't necessarily inherit the MTU, so set it explicitly on the host end too.
+		if conf.MTU != 0 {
+			if err = netlink.LinkSetMTU(hostVeth, conf.MTU); err != nil {
+				return fmt.Errorf("failed to set MTU %d on %q: %v", conf.MTU, hostVethName, err)
+			}
+		}
+
 		contVeth, err := netlink.LinkByName(contVethName)
 		if err != nil {
 			err = fmt.Errorf("failed to lookup %q: %v", contVethName, err)
@@ -57,8 +71,17 @@ func DoNetworking(args *skel.CmdArgs, conf NetConf, res *types.Result, logger *l
 		// At this point, the virtual ethernet pair has been created, and both ends have the right names.
 		// Both ends of the veth are still in the container's network namespace.
 
+		var hasIPv4, hasIPv6 bool
+		for _, ipConfig := range res.IPs {
+			if ipConfig.Version == "4" {
+				hasIPv4 = true
+			} else {
+				hasIPv6 = true
+			}
+		}
+
 		// Before returning, create the routes inside the namespace, first for IPv4 then IPv6.
-		if res.IP4 != nil {
+		if hasIPv4 {
 			// Add a connected route to a dummy next hop so that a default route can be set
 			gw := net.IPv4(169, 254, 1, 1)
 			gwNet := &net.IPNet{IP: gw, Mask: net.CIDRMask(32, 32)}
@@ -73,13 +96,12 @@ func DoNetworking(args *skel.CmdArgs, conf NetConf, res *types.Result, logger *l
 				return fmt.Errorf("failed to add route %v", err)
 			}
 
-			if err = netlink.AddrAdd(contVeth, &netlink.Addr{IPNet: &res.IP4.IP}); err != nil {
-				return fmt.Errorf("failed to add IP addr to %q: %v", contVethName, err)
-			}
+			_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
+			res.Routes = append(res.Routes, &types.Route{Dst: *defNet, GW: gw})
 		}
 
 		// Handle IPv6 routes
-		if res.IP6 != nil {
+		if hasIPv6 {
 			// No need to add a dummy next hop route as the host veth device will already have an IPv6
 			// link local address that can be used as a next hop.
 			// Just fetch the address of the host end of the veth and use it as the next hop.
@@ -109,9 +131,13 @@ func DoNetworking(args *skel.CmdArgs, conf NetConf, res *types.Result, logger *l
 			if err = ip.AddRoute(defNet, hostIPv6Addr, contVeth); err != nil {
 				return fmt.Errorf("failed to add default gateway to %v %v", hostIPv6Addr, err)
 			}
+			res.Routes = append(res.Routes, &types.Route{Dst: *defNet, GW: hostIPv6Addr})
+		}
 
-			if err = netlink.AddrAdd(contVeth, &netlink.Addr{IPNet: &res.IP6.IP}); err != nil {
-				return fmt.Errorf("failed to add IP addr to %q: %v", contVeth, err)
+		// Add the IP addresses to the container end of the veth.
+		for _, ipConfig := range res.IPs {
+			if err = netlink.AddrAdd(contVeth, &netlink.Addr{IPNet: &ipConfig.Address}); err != nil {
+				return fmt.Errorf("failed to add IP addr to %q: %v", contVethName, err)
 			}
 		}
 
@@ -121,7 +147,8 @@ func DoNetworking(args *skel.CmdArgs, conf NetConf, res *types.Result, logger *l
 			return fmt.Errorf("failed to move veth to host netns: %v", err)
 		}
 
-		return nil
+		// Apply any sysctls for the container end of the veth.
+		return setSysctls(conf.Sysctls.ContainerInterface, contVethName, logger)
 	})
 
 	if err != nil {
@@ -140,5 +167,64 @@ func DoNetworking(args *skel.CmdArgs, conf NetConf, res *types.Result, logger *l
 		return "", "", fmt.Errorf("failed to set %q up: %v", hostVethName, err)
 	}
 
+	// Apply any sysctls for the host end of the veth.
+	if err = setSysctls(conf.Sysctls.HostInterface, hostVethName, logger); err != nil {
+		return "", "", err
+	}
+
+	// Record both ends of the veth in the result. All of the IPs are on the container end.
+	res.Interfaces = []*current.Interface{
+		{Name: hostVethName, Mac: hostVeth.Attrs().HardwareAddr.String()},
+		{Name: contVethName, Mac: contVethMAC, Sandbox: args.Netns},
+	}
+	for _, ipConfig := range res.IPs {
+		ipConfig.Interface = 1
+	}
+
 	return hostVethName, contVethMAC, err
 }
+
+// sysctlIfNamePlaceholder is replaced with the interface name in configured sysctl keys,
+// e.g. net.ipv4.conf.IFNAME.proxy_arp
+const sysctlIfNamePlaceholder = "IFNAME"
+
+var sysctlKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-]+(\.[a-zA-Z0-9_\-]+)*$`)
+
+// ValidateSysctls checks that the configured sysctl keys are well formed, so that a bad key is rejected before
+// anything is allocated or created. Whether the sysctl exists can only be checked once the interface does.
+func ValidateSysctls(sysctls Sysctls) error {
+	for _, m := range []map[string]string{sysctls.HostInterface, sysctls.ContainerInterface} {
+		for key := range m {
+			if !sysctlKeyRegex.MatchString(key) {
+				return fmt.Errorf("Invalid sysctl key %q", key)
+			}
+		}
+	}
+	return nil
+}
+
+// setSysctls writes the sysctls for the given interface in the current network namespace.
+func setSysctls(sysctls map[string]string, ifName string, logger *log.Entry) error {
+	// Apply the sysctls in a predictable order.
+	keys := []string{}
+	for key := range sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// Convert the key to a path before substituting the interface name, since the name may contain dots.
+		path := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+		path = strings.Replace(path, sysctlIfNamePlaceholder, ifName, -1)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("invalid sysctl key %q for %q: %v", key, ifName, err)
+		}
+
+		value := sysctls[key]
+		logger.WithFields(log.Fields{"key": key, "value": value, "path": path}).Debug("Setting sysctl")
+		if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to set sysctl %q to %q for %q: %v", key, value, ifName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Tigera Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// DefaultStateDir is where workload state files are written if the network config doesn't specify a state_dir.
+const DefaultStateDir = "/var/lib/cni/calico"
+
+// WorkloadState records what an ADD set up for a workload, with enough information to undo it later without the
+// original CNI invocation.
+type WorkloadState struct {
+	Workload     string          `json:"workload"`
+	ContainerID  string          `json:"container_id"`
+	IfName       string          `json:"if_name"`
+	Netns        string          `json:"netns"`
+	PodNamespace string          `json:"pod_namespace"`
+	PodName      string          `json:"pod_name"`
+	PodUID       string          `json:"pod_uid"`
+	IPAMType     string          `json:"ipam_type"`
+	IPs          []cnet.IPNet    `json:"ips"`
+	CNIArgs      string          `json:"cni_args"`
+	CNIPath      string          `json:"cni_path"`
+	StdinData    json.RawMessage `json:"stdin_data"`
+	Created      time.Time       `json:"created"`
+}
+
+// StateDir returns the directory holding the workload state files.
+func StateDir(conf NetConf) string {
+	if conf.StateDir != "" {
+		return conf.StateDir
+	}
+	return DefaultStateDir
+}
+
+// stateFilePath returns the state file for a workload. Files are keyed by both the workload and the container ID
+// so that a new sandbox for the same workload doesn't overwrite the state of an old one.
+func stateFilePath(conf NetConf, workload, containerID string) (string, error) {
+	name := fmt.Sprintf("%s_%s.json", workload, containerID)
+	if strings.ContainsRune(name, os.PathSeparator) {
+		return "", fmt.Errorf("Invalid workload state file name %q", name)
+	}
+	return filepath.Join(StateDir(conf), name), nil
+}
+
+// WriteWorkloadState atomically writes the state file for a workload.
+func WriteWorkloadState(conf NetConf, state WorkloadState) error {
+	path, err := stateFilePath(conf, state.Workload, state.ContainerID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// RemoveWorkloadState removes the state file for a workload. It's not an error for the file not to exist.
+func RemoveWorkloadState(conf NetConf, workload, containerID string) error {
+	path, err := stateFilePath(conf, workload, containerID)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListWorkloadStates returns all of the workload state files on this host. Files that can't be read are logged and
+// skipped.
+func ListWorkloadStates(conf NetConf) ([]WorkloadState, error) {
+	paths, err := filepath.Glob(filepath.Join(StateDir(conf), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	states := []WorkloadState{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to read workload state %s", path)
+			continue
+		}
+
+		state := WorkloadState{}
+		if err = json.Unmarshal(data, &state); err != nil {
+			log.WithError(err).Warnf("Failed to parse workload state %s", path)
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// WriteFileAtomic writes data to a temporary file alongside path and renames it into place so that concurrent
+// readers never see a partially written file.
+func WriteFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
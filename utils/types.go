@@ -8,19 +8,30 @@ import (
 
 // Policy is a struct to hold policy config (which currently happens to also contain some K8s config)
 type Policy struct {
-	PolicyType              string `json:"type"`
-	K8sAPIRoot              string `json:"k8s_api_root"`
-	K8sAuthToken            string `json:"k8s_auth_token"`
-	K8sClientCertificate    string `json:"k8s_client_certificate"`
-	K8sClientKey            string `json:"k8s_client_key"`
-	K8sCertificateAuthority string `json:"k8s_certificate_authority"`
+	PolicyType              string   `json:"type"`
+	K8sAPIRoot              string   `json:"k8s_api_root"`
+	K8sAuthToken            string   `json:"k8s_auth_token"`
+	K8sAuthTokenFile        string   `json:"k8s_auth_token_file"`
+	K8sClientCertificate    string   `json:"k8s_client_certificate"`
+	K8sClientKey            string   `json:"k8s_client_key"`
+	K8sCertificateAuthority string   `json:"k8s_certificate_authority"`
+	ExtraProfiles           []string `json:"extra_profiles"`
+}
+
+// Sysctls holds the sysctls to set on each end of the veth. The string IFNAME in a key is replaced with the
+// name of the interface.
+type Sysctls struct {
+	HostInterface      map[string]string `json:"host_interface"`
+	ContainerInterface map[string]string `json:"container_interface"`
 }
 
 // Kubernetes a K8s specific struct to hold config
 type Kubernetes struct {
-	K8sAPIRoot string `json:"k8s_api_root"`
-	Kubeconfig string `json:"kubeconfig"`
-	NodeName   string `json:"node_name"`
+	K8sAPIRoot       string `json:"k8s_api_root"`
+	K8sAuthTokenFile string `json:"k8s_auth_token_file"`
+	Kubeconfig       string `json:"kubeconfig"`
+	NodeName         string `json:"node_name"`
+	PodCidrCacheFile string `json:"pod_cidr_cache_file"`
 }
 
 type Args struct {
@@ -43,9 +54,10 @@ type NetworkInfo struct {
 
 // NetConf stores the common network config for Calico CNI plugin
 type NetConf struct {
-	Name string `json:"name"`
-	Type string `json:"type"`
-	IPAM struct {
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	IPAM       struct {
 		Name       string
 		Type       string  `json:"type"`
 		Subnet     string  `json:"subnet"`
@@ -60,6 +72,8 @@ type NetConf struct {
 	LogLevel       string     `json:"log_level"`
 	Policy         Policy     `json:"policy"`
 	Kubernetes     Kubernetes `json:"kubernetes"`
+	Sysctls        Sysctls    `json:"sysctls"`
+	StateDir       string     `json:"state_dir"`
 	Args           Args       `json:"args"`
 	EtcdScheme     string     `json:"etcd_scheme"`
 	EtcdKeyFile    string     `json:"etcd_key_file"`
@@ -27,6 +27,8 @@ import (
 	"github.com/containernetworking/cni/pkg/ipam"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/client"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
@@ -52,6 +54,15 @@ func ValidateNetworkName(name string) error {
 	return nil
 }
 
+// ValidateMTU checks that the MTU is within the range supported by the kernel. A value of 0 means use the default.
+// The kernel won't carry IPv4 over an interface with an MTU below 68.
+func ValidateMTU(mtu int) error {
+	if mtu != 0 && (mtu < 68 || mtu > 65536) {
+		return fmt.Errorf("Invalid MTU %d, must be 0 (the default) or between 68 and 65536", mtu)
+	}
+	return nil
+}
+
 // AddIgnoreUnknownArgs appends the 'IgnoreUnknown=1' option to CNI_ARGS before calling the IPAM plugin. Otherwise, it will
 // complain about the Kubernetes arguments. See https://github.com/kubernetes/kubernetes/pull/24983
 func AddIgnoreUnknownArgs() error {
@@ -62,27 +73,63 @@ func AddIgnoreUnknownArgs() error {
 	return os.Setenv("CNI_ARGS", cniArgs)
 }
 
-func CreateResultFromEndpoint(ep *api.WorkloadEndpoint) (*types.Result, error) {
-	result := &types.Result{}
+func CreateResultFromEndpoint(ep *api.WorkloadEndpoint) (*current.Result, error) {
+	result := &current.Result{}
 
 	for _, v := range ep.Spec.IPNetworks {
-		unparsedIP := fmt.Sprintf(`{"ip": "%s"}`, v.String())
-		parsedIP := types.IPConfig{}
-		if err := parsedIP.UnmarshalJSON([]byte(unparsedIP)); err != nil {
-			log.Errorf("Error unmarshalling existing endpoint IP: %s", err)
-			return nil, err
-		}
-
-		if len(v.IP) == net.IPv4len {
-			result.IP4 = &parsedIP
+		ipConfig := &current.IPConfig{Address: v.IPNet}
+		if v.IP.To4() != nil {
+			ipConfig.Version = "4"
 		} else {
-			result.IP6 = &parsedIP
+			ipConfig.Version = "6"
 		}
+		result.IPs = append(result.IPs, ipConfig)
 	}
 
 	return result, nil
 }
 
+// PrintResult prints the result in the format for the CNI version requested in the network config. Configs that
+// don't specify a version, or that ask for 0.1.0 or 0.2.0, get the legacy format. That only ever included the routes
+// returned by IPAM, so those are passed in separately from the routes in the result.
+func PrintResult(result *current.Result, ipamRoutes []*types.Route, cniVersion string) error {
+	switch cniVersion {
+	case "", "0.1.0", "0.2.0":
+		return legacyResult(result, ipamRoutes).Print()
+	}
+
+	r, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		return err
+	}
+	return r.Print()
+}
+
+// legacyResult converts the result to the pre-0.3.0 format, which only has room for one address of each IP version.
+func legacyResult(result *current.Result, ipamRoutes []*types.Route) *types020.Result {
+	r := &types020.Result{DNS: result.DNS}
+
+	for _, ipConfig := range result.IPs {
+		if ipConfig.Version == "4" && r.IP4 == nil {
+			r.IP4 = &types020.IPConfig{IP: ipConfig.Address, Gateway: ipConfig.Gateway}
+		} else if ipConfig.Version == "6" && r.IP6 == nil {
+			r.IP6 = &types020.IPConfig{IP: ipConfig.Address, Gateway: ipConfig.Gateway}
+		}
+	}
+
+	for _, route := range ipamRoutes {
+		if route.Dst.IP.To4() != nil {
+			if r.IP4 != nil {
+				r.IP4.Routes = append(r.IP4.Routes, *route)
+			}
+		} else if r.IP6 != nil {
+			r.IP6.Routes = append(r.IP6.Routes, *route)
+		}
+	}
+
+	return r
+}
+
 func GetIdentifiers(args *skel.CmdArgs) (workloadID string, orchestratorID string, err error) {
 	// Determine if running under k8s by checking the CNI args
 	k8sArgs := K8sArgs{}
@@ -100,19 +147,18 @@ func GetIdentifiers(args *skel.CmdArgs) (workloadID string, orchestratorID strin
 	return workloadID, orchestratorID, nil
 }
 
-func PopulateEndpointNets(endpoint *api.WorkloadEndpoint, result *types.Result) error {
-	if result.IP4 == nil && result.IP6 == nil {
+func PopulateEndpointNets(endpoint *api.WorkloadEndpoint, result *current.Result) error {
+	if len(result.IPs) == 0 {
 		return errors.New("IPAM plugin did not return any IP addresses")
 	}
 
-	if result.IP4 != nil {
-		result.IP4.IP.Mask = net.CIDRMask(32, 32)
-		endpoint.Spec.IPNetworks = append(endpoint.Spec.IPNetworks, cnet.IPNet{result.IP4.IP})
-	}
-
-	if result.IP6 != nil {
-		result.IP6.IP.Mask = net.CIDRMask(128, 128)
-		endpoint.Spec.IPNetworks = append(endpoint.Spec.IPNetworks, cnet.IPNet{result.IP6.IP})
+	for _, ipConfig := range result.IPs {
+		if ipConfig.Version == "4" {
+			ipConfig.Address.Mask = net.CIDRMask(32, 32)
+		} else {
+			ipConfig.Address.Mask = net.CIDRMask(128, 128)
+		}
+		endpoint.Spec.IPNetworks = append(endpoint.Spec.IPNetworks, cnet.IPNet{ipConfig.Address})
 	}
 
 	return nil